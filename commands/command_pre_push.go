@@ -7,13 +7,15 @@ import (
 
 	"github.com/git-lfs/git-lfs/git"
 	"github.com/git-lfs/git-lfs/lfs"
-	"github.com/git-lfs/git-lfs/locking"
+	"github.com/git-lfs/git-lfs/tq"
 	"github.com/rubyist/tracerx"
 	"github.com/spf13/cobra"
 )
 
 var (
 	prePushDryRun       = false
+	prePushAll          = false
+	prePushRecover      = false
 	prePushDeleteBranch = strings.Repeat("0", 40)
 )
 
@@ -39,6 +41,21 @@ var (
 //
 // In the case of deleting a branch, no attempts to push Git LFS objects will be
 // made.
+//
+// With --all, the diff walk above is skipped in favor of scanning the full
+// history of each local ref, including objects belonging to commits that
+// have since been deleted, so that `git lfs push --all <remote>` can
+// re-upload historical Git LFS objects a remote is missing.
+//
+// With --recover, or automatically whenever a ref's local and remote sha1s
+// already match, the diff walk is skipped as well: every Git LFS pointer
+// reachable from the local ref is enumerated and only the OIDs the remote
+// reports missing are uploaded. This heals a repository that was left with
+// pointers on the remote whose objects never made it to the Git LFS API,
+// without re-uploading everything the way --all does. --all always wins
+// over both --recover and this automatic detection, so `git lfs push --all` on an already
+// up-to-date ref still re-uploads its full history instead of only the
+// objects the remote reports missing.
 func prePushCommand(cmd *cobra.Command, args []string) {
 	if len(args) == 0 {
 		Print("This should be run through Git's pre-push hook.  Run `git lfs update` to install it.")
@@ -64,23 +81,13 @@ func prePushCommand(cmd *cobra.Command, args []string) {
 	// We can be passed multiple lines of refs
 	scanner := bufio.NewScanner(os.Stdin)
 
-	name, email := cfg.CurrentCommitter()
-	lc, err := locking.NewClient(cfg)
-	if err != nil {
-		Exit("Unable to create lock system: %v", err.Error())
-	}
-	defer lc.Close()
+	lockVerifier := newLockVerifier(ctx.Remote)
+	defer lockVerifier.Close()
 
-	locks, err := lc.SearchLocks(map[string]string{}, 0, false)
-	if err != nil {
-		Exit("error finding locks: %s", err)
-	}
-	lockSet := make(map[string]locking.Lock, len(locks))
-	for _, l := range locks {
-		lockSet[l.Name] = l
-	}
-	lockConflicts := make([]string, 0, len(locks))
-	myLocks := make([]string, 0, len(locks))
+	// Each ref's queue is kept around, rather than drained as soon as it's
+	// built, so that scanning ref N+1 can start while ref N's objects are
+	// still uploading in the background.
+	var queues []*tq.TransferQueue
 
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -91,64 +98,59 @@ func prePushCommand(cmd *cobra.Command, args []string) {
 
 		tracerx.Printf("pre-push: %s", line)
 
-		left, _ := decodeRefs(line)
-		if left == prePushDeleteBranch {
+		update := decodeRefUpdate(line)
+		if update == nil {
 			continue
 		}
 
-		for _, p := range pointers {
-			if l, ok := lockSet[p.Name]; ok {
-				if l.Name == name && l.Email == email {
-					myLocks = append(myLocks, l.Path)
-				} else {
-					lockConflicts = append(lockConflicts, p.Name)
-				}
-			}
+		if update.LeftCommitish() == prePushDeleteBranch {
+			continue
 		}
 
-		if len(lockConflicts) > 0 {
-			Error("Some files are locked in %s...%s", left, cfg.CurrentRemote)
-			for _, file := range lockConflicts {
-				Error("* %s", file)
-			}
-			os.Exit(1)
+		var q *tq.TransferQueue
+		var err error
+		if !prePushAll && (prePushRecover || update.LeftCommitish() == update.RightCommitish()) {
+			q, err = recoverMissing(gitscanner, ctx, update, lockVerifier)
+		} else {
+			q, err = uploadLeftOrAll(gitscanner, ctx, update, prePushAll, lockVerifier)
 		}
 
-		if err := uploadLeftOrAll(gitscanner, ctx, left); err != nil {
-			Print("Error scanning for Git LFS files in %q", left)
+		if err != nil {
+			Print("Error scanning for Git LFS files in %q", update.Left())
 			ExitWithError(err)
 		}
-	}
 
-	if len(myLocks) > 0 {
-		Print("Pushing your locked files:")
-		for _, file := range myLocks {
-			Print("* %s", file)
+		if q != nil {
+			queues = append(queues, q)
 		}
 	}
 
-	ctx.Await()
-}
-
-// decodeRefs pulls the sha1s out of the line read from the pre-push
-// hook's stdin.
-func decodeRefs(input string) (string, string) {
-	refs := strings.Split(strings.TrimSpace(input), " ")
-	var left, right string
+	lockVerifier.Verify()
 
-	if len(refs) > 1 {
-		left = refs[1]
+	for _, q := range queues {
+		ctx.CollectErrors(q)
 	}
+	ctx.ReportErrors()
+}
 
-	if len(refs) > 3 {
-		right = "^" + refs[3]
+// decodeRefUpdate parses a line read from the pre-push hook's stdin, of the
+// form "<local ref> <local sha1> <remote ref> <remote sha1>", into a
+// *git.RefUpdate. It returns nil if the line doesn't carry enough fields to
+// build one.
+func decodeRefUpdate(input string) *git.RefUpdate {
+	refs := strings.Split(strings.TrimSpace(input), " ")
+	if len(refs) < 4 {
+		return nil
 	}
 
-	return left, right
+	update := git.NewRefUpdate(refs[0], refs[1], refs[2], refs[3])
+	return &update
 }
 
 func init() {
 	RegisterCommand("pre-push", prePushCommand, func(cmd *cobra.Command) {
 		cmd.Flags().BoolVarP(&prePushDryRun, "dry-run", "d", false, "Do everything except actually send the updates")
+		cmd.Flags().BoolVarP(&prePushAll, "all", "a", false, "Push all previously pushed and deleted Git LFS objects for the given refs")
+		cmd.Flags().BoolVarP(&prePushRecover, "recover", "r", false, "Re-upload any Git LFS objects the remote is missing, even if its ref already matches the local one")
 	})
 }
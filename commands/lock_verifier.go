@@ -0,0 +1,141 @@
+package commands
+
+import (
+	"os"
+
+	"github.com/git-lfs/git-lfs/lfs"
+	"github.com/git-lfs/git-lfs/locking"
+)
+
+// lockVerifier checks the pointers a push discovers against the locks held
+// on a remote, reporting any file that is locked by someone other than the
+// current committer. It is constructed once per push and queries the lock
+// server only for the paths the scanner actually turns up, caching each
+// path it has already asked about, instead of pulling every lock on the
+// server the way the old inline check did. On a remote with thousands of
+// active locks this keeps lookup cost proportional to the objects being
+// pushed rather than to the server's total lock count.
+type lockVerifier struct {
+	remote string
+	name   string
+	email  string
+
+	enabled bool
+	lc      *locking.Client
+
+	queried map[string]bool
+	lockSet map[string]locking.Lock
+
+	ours   []string
+	theirs []string
+}
+
+// newLockVerifier builds a lockVerifier for the given remote, honoring the
+// `lfs.<remote>.locksverify` escape hatch so a push can proceed even when
+// the lock server is unreachable.
+func newLockVerifier(remote string) *lockVerifier {
+	name, email := cfg.CurrentCommitter()
+
+	value, _ := cfg.Git.Get("lfs." + remote + ".locksverify")
+
+	return &lockVerifier{
+		remote:  remote,
+		name:    name,
+		email:   email,
+		enabled: value != "false",
+		queried: make(map[string]bool),
+		lockSet: make(map[string]locking.Lock),
+	}
+}
+
+// Check reports whether p is locked by someone other than the current
+// committer, querying the lock server for p's path the first time it's
+// seen. Callers must skip queuing p for upload when Check returns true — it
+// is the only thing that keeps a conflicting object from reaching the
+// remote, since Verify only reports conflicts after every ref has been
+// scanned. Failures to reach the lock server are reported but do not block
+// the push, matching the locksverify escape hatch.
+func (v *lockVerifier) Check(p *lfs.WrappedPointer) bool {
+	if !v.enabled {
+		return false
+	}
+
+	if err := v.fetch(p.Name); err != nil {
+		Error("Warning: verifying locks failed: %v", err)
+		v.enabled = false
+		return false
+	}
+
+	l, ok := v.lockSet[p.Name]
+	if !ok {
+		return false
+	}
+
+	if l.Name == v.name && l.Email == v.email {
+		v.ours = append(v.ours, l.Path)
+		return false
+	}
+
+	v.theirs = append(v.theirs, p.Name)
+	return true
+}
+
+// fetch looks up the locks held on path, if any, the first time path is
+// asked about, and caches the result so the same path seen again later in
+// the push (e.g. across several refs, or several revisions of the same
+// scanned ref) doesn't trigger a second round trip.
+func (v *lockVerifier) fetch(path string) error {
+	if v.queried[path] {
+		return nil
+	}
+	v.queried[path] = true
+
+	if v.lc == nil {
+		lc, err := locking.NewClient(cfg)
+		if err != nil {
+			return err
+		}
+		v.lc = lc
+	}
+
+	locks, err := v.lc.SearchLocks(map[string]string{"path": path}, 0, false)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range locks {
+		v.lockSet[l.Path] = l
+	}
+
+	return nil
+}
+
+// Verify prints every conflict accumulated across all refs pushed so far
+// and exits the process if any were found. Call it once, after every ref
+// has been scanned. It is only a final report: Check is what actually keeps
+// a conflicting object out of the upload queues as it's discovered, so
+// nothing locked by someone else reaches the remote even though Verify
+// itself runs afterward.
+func (v *lockVerifier) Verify() {
+	if len(v.theirs) > 0 {
+		Error("Some files are locked in %s", v.remote)
+		for _, file := range v.theirs {
+			Error("* %s", file)
+		}
+		os.Exit(1)
+	}
+
+	if len(v.ours) > 0 {
+		Print("Pushing your locked files:")
+		for _, file := range v.ours {
+			Print("* %s", file)
+		}
+	}
+}
+
+// Close releases the lock server connection, if one was ever opened.
+func (v *lockVerifier) Close() {
+	if v.lc != nil {
+		v.lc.Close()
+	}
+}
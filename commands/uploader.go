@@ -0,0 +1,149 @@
+package commands
+
+import (
+	"os"
+
+	"github.com/git-lfs/git-lfs/git"
+	"github.com/git-lfs/git-lfs/lfs"
+	"github.com/git-lfs/git-lfs/tq"
+)
+
+// uploadContext carries the state shared by every ref that a single push or
+// pre-push hook invocation uploads Git LFS objects for.
+type uploadContext struct {
+	Remote string
+	DryRun bool
+
+	manifest *tq.Manifest
+	errors   []error
+}
+
+func newUploadContext(remote string, dryRun bool) *uploadContext {
+	return &uploadContext{
+		Remote:   remote,
+		DryRun:   dryRun,
+		manifest: getTransferManifest(),
+	}
+}
+
+// NewQueue builds a TransferQueue uploading to this context's remote. Each
+// ref being pushed gets its own queue, so scanning the next ref can start
+// right away instead of waiting for the previous ref's queue to finish
+// uploading — callers are expected to hold onto the returned queue and only
+// call CollectErrors on it once every ref has been scanned, not before
+// moving on to the next one.
+func (c *uploadContext) NewQueue(opts ...tq.Option) *tq.TransferQueue {
+	return tq.NewTransferQueue(tq.Upload, c.manifest, c.Remote, opts...)
+}
+
+// CollectErrors waits for q to finish and appends any errors it produced to
+// the context's running total, to be reported once every ref has been
+// processed. Call this only after every ref's queue has been built and
+// handed off, so q's upload isn't blocking the scan of later refs.
+func (c *uploadContext) CollectErrors(q *tq.TransferQueue) {
+	q.Wait()
+	c.errors = append(c.errors, q.Errors()...)
+}
+
+// ReportErrors prints every error collected across all the refs pushed so
+// far, grouped into a single report, and exits if there were any.
+func (c *uploadContext) ReportErrors() {
+	if len(c.errors) == 0 {
+		return
+	}
+
+	for _, err := range c.errors {
+		Error(err.Error())
+	}
+	os.Exit(2)
+}
+
+// uploadLeftOrAll scans for Git LFS objects reachable from update, checking
+// each one against lv as it's discovered and streaming it into a per-ref
+// TransferQueue as it's found. It returns that queue without waiting for it
+// to drain, so the caller can move on to scanning the next ref while this
+// one's objects are still uploading in the background; the caller is
+// responsible for collecting the queue's errors once every ref has been
+// scanned. When pushAll is true, the full history of update's left-hand ref
+// is walked, including objects belonging to commits that have since been
+// deleted, so that a remote missing historical LFS content can be healed by
+// `git lfs push --all`. Otherwise only the commits being introduced by this
+// push are scanned.
+func uploadLeftOrAll(g *lfs.GitScanner, ctx *uploadContext, update *git.RefUpdate, pushAll bool, lv *lockVerifier) (*tq.TransferQueue, error) {
+	q := ctx.NewQueue(tq.RemoteRef(update.Right()))
+
+	cb := func(p *lfs.WrappedPointer, err error) {
+		if err != nil {
+			Panic(err, "Error scanning for Git LFS files in %q", update.Left())
+		}
+
+		if lv.Check(p) {
+			return
+		}
+
+		if ctx.DryRun {
+			Print("push %s => %s", p.Oid, p.Name)
+			return
+		}
+
+		q.Add(p.Name, p.Pointer)
+	}
+
+	var scanErr error
+	if pushAll {
+		scanErr = g.ScanRefWithDeleted(update.LeftCommitish(), cb)
+	} else {
+		scanErr = g.ScanLeftToRemote(update.LeftCommitish(), cb)
+	}
+
+	return q, scanErr
+}
+
+// recoverMissing heals a partially-pushed ref whose local and remote sha1s
+// already match, which would otherwise make the diff walk in
+// uploadLeftOrAll empty and leave any objects that never made it to the LFS
+// API stranded. It enumerates every Git LFS pointer reachable from update,
+// including ones belonging to commits that have since been deleted, asks
+// the remote which of their OIDs it's actually missing, and uploads only
+// those. Like uploadLeftOrAll, it returns the queue it built without
+// draining it, so the caller can scan the next ref while this one uploads
+// in the background; a nil queue means there was nothing missing to upload.
+func recoverMissing(g *lfs.GitScanner, ctx *uploadContext, update *git.RefUpdate, lv *lockVerifier) (*tq.TransferQueue, error) {
+	var pointers []*lfs.WrappedPointer
+
+	cb := func(p *lfs.WrappedPointer, err error) {
+		if err != nil {
+			Panic(err, "Error scanning for Git LFS files in %q", update.Left())
+		}
+
+		pointers = append(pointers, p)
+	}
+
+	if err := g.ScanRefWithDeleted(update.LeftCommitish(), cb); err != nil {
+		return nil, err
+	}
+
+	missing, err := tq.Missing(ctx.manifest, ctx.Remote, pointers)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	q := ctx.NewQueue(tq.RemoteRef(update.Right()))
+	for _, p := range missing {
+		if lv.Check(p) {
+			continue
+		}
+
+		if ctx.DryRun {
+			Print("push %s => %s", p.Oid, p.Name)
+			continue
+		}
+		q.Add(p.Name, p.Pointer)
+	}
+
+	return q, nil
+}